@@ -18,6 +18,24 @@ type Config struct {
 	// Whether to skip TLS verify.
 	NoVerify bool `json:"no-verify" toml:"no-verify" yaml:"no-verify"`
 
+	// TLSMode controls how (and whether) TLS is negotiated with the SMTP
+	// server. One of "none", "starttls", "starttls-required", or "tls".
+	// Defaults to "starttls" (opportunistic) when empty.
+	TLSMode string `json:"tls-mode" toml:"tls-mode" yaml:"tls-mode"`
+
+	// CAFile is a path to a PEM encoded CA bundle used to verify the SMTP
+	// server's certificate, for servers with a private/internal CA.
+	CAFile string `json:"ca-file" toml:"ca-file" yaml:"ca-file"`
+
+	// ClientCert and ClientKey are paths to a PEM encoded client certificate
+	// and key, for servers that require client certificate authentication.
+	ClientCert string `json:"client-cert" toml:"client-cert" yaml:"client-cert"`
+	ClientKey  string `json:"client-key" toml:"client-key" yaml:"client-key"`
+
+	// ServerName overrides the hostname used to verify the server's
+	// certificate. Defaults to Host.
+	ServerName string `json:"server-name" toml:"server-name" yaml:"server-name"`
+
 	// Whether all alerts should trigger an email.
 	Global bool `json:"global" toml:"global" yaml:"global"`
 
@@ -33,8 +51,81 @@ type Config struct {
 
 	// Close connection to SMTP server after idle timeout has elapsed
 	IdleTimeout time.Duration `json:"idle-timeout" toml:"idle-timeout" yaml:"idle-timeout"`
+
+	// UsePlainText sends the message body as text/plain instead of text/html.
+	UsePlainText bool `json:"use-plain-text" toml:"use-plain-text" yaml:"use-plain-text"`
+
+	// AddPlainTextAlt adds a text/plain alternative part generated from the
+	// HTML body, similar to how Gogs/Gitea use html2text, so mail clients
+	// that don't render HTML still get readable content. Ignored when
+	// UsePlainText is set.
+	AddPlainTextAlt bool `json:"add-plain-text-alt" toml:"add-plain-text-alt" yaml:"add-plain-text-alt"`
+
+	// SubjectPrefix is prepended to every alert subject, e.g. "[goticket] ".
+	SubjectPrefix string `json:"subject-prefix" toml:"subject-prefix" yaml:"subject-prefix"`
+
+	// QueueSize is the number of outgoing messages that may be buffered
+	// waiting to be sent before SendMail/SendMessage starts blocking.
+	// Defaults to 100 when not set.
+	QueueSize int `json:"queue-size" toml:"queue-size" yaml:"queue-size"`
+
+	// SpoolDir, if set, persists the outbound queue to disk so pending
+	// messages survive a restart or a prolonged SMTP outage instead of being
+	// lost.
+	SpoolDir string `json:"spool-dir" toml:"spool-dir" yaml:"spool-dir"`
+
+	// MaxRetries is the number of times a failed send is retried before the
+	// message is dropped and reported via Diagnostic.DeadLetter. Zero means
+	// retry forever.
+	MaxRetries int `json:"max-retries" toml:"max-retries" yaml:"max-retries"`
+
+	// RetryInterval is the base delay before the first retry of a failed
+	// send; the delay doubles on each subsequent attempt. Defaults to one
+	// second when not set.
+	RetryInterval time.Duration `json:"retry-interval" toml:"retry-interval" yaml:"retry-interval"`
+
+	// ServerListen is the address the inbound SMTP receiver listens on,
+	// e.g. ":2525". Leave empty to disable the receiver.
+	ServerListen string `json:"server-listen" toml:"server-listen" yaml:"server-listen"`
+
+	// ServerDomain is the domain name the inbound receiver presents in its
+	// banner and HELO/EHLO response.
+	ServerDomain string `json:"server-domain" toml:"server-domain" yaml:"server-domain"`
+
+	// ServerAddrPrefix is the local-part prefix that maps an inbound
+	// recipient to a Kapacitor topic, e.g. "alert-" so that mail sent to
+	// "alert-cpu@example.com" is routed to the "cpu" topic.
+	ServerAddrPrefix string `json:"server-addr-prefix" toml:"server-addr-prefix" yaml:"server-addr-prefix"`
+
+	// PoolSize is the number of concurrent SMTP connections to maintain for
+	// sending. Defaults to 1 (a single connection, the prior behavior).
+	PoolSize int `json:"pool-size" toml:"pool-size" yaml:"pool-size"`
+
+	// MaxMessagesPerSession re-dials a pooled connection after it has sent
+	// this many messages, to stay under relays that cap messages per
+	// session. Zero means no limit.
+	MaxMessagesPerSession int `json:"max-messages-per-session" toml:"max-messages-per-session" yaml:"max-messages-per-session"`
 }
 
+// TLS modes accepted by Config.TLSMode.
+const (
+	// TLSModeNone disables TLS entirely, sending mail in cleartext. Unlike
+	// the other modes this bypasses gomail's own dialer, which has no way
+	// to suppress an opportunistic STARTTLS upgrade once the server
+	// advertises it.
+	TLSModeNone = "none"
+	// TLSModeSTARTTLS opportunistically upgrades to TLS via STARTTLS when
+	// the server advertises support for it, falling back to cleartext
+	// otherwise. This is the default.
+	TLSModeSTARTTLS = "starttls"
+	// TLSModeSTARTTLSRequired upgrades to TLS via STARTTLS and refuses to
+	// send if the server does not advertise STARTTLS, rather than silently
+	// falling back to cleartext.
+	TLSModeSTARTTLSRequired = "starttls-required"
+	// TLSModeTLS connects using implicit TLS (commonly port 465).
+	TLSModeTLS = "tls"
+)
+
 // NewConfig creates a new config with default values.
 //    return Config{
 //        Host: "localhost",
@@ -56,6 +147,8 @@ func NewConfig() Config {
 //     4. From field is not empty.
 //     5. From contains '@'.
 //     6. To(s) contains '@'.
+//     7. TLSMode, if set, is one of the known modes.
+//     8. ClientCert and ClientKey are either both set or both empty.
 func (c Config) Validate() error {
 	if c.Host == "" {
 		return errors.New("host cannot be empty")
@@ -69,6 +162,32 @@ func (c Config) Validate() error {
 	if c.Enabled && c.From == "" {
 		return errors.New("must provide a 'from' address")
 	}
+	switch c.TLSMode {
+	case "", TLSModeNone, TLSModeSTARTTLS, TLSModeSTARTTLSRequired, TLSModeTLS:
+	default:
+		return errors.Errorf("invalid tls-mode %q", c.TLSMode)
+	}
+	if (c.ClientCert == "") != (c.ClientKey == "") {
+		return errors.New("client-cert and client-key must either both be set or both be empty")
+	}
+	if c.QueueSize < 0 {
+		return errors.New("queue-size must not be negative")
+	}
+	if c.MaxRetries < 0 {
+		return errors.New("max-retries must not be negative")
+	}
+	if c.RetryInterval < 0 {
+		return errors.New("retry-interval must not be negative")
+	}
+	if c.ServerListen != "" && c.ServerAddrPrefix == "" {
+		return errors.New("server-addr-prefix must be set when server-listen is set")
+	}
+	if c.PoolSize < 0 {
+		return errors.New("pool-size must not be negative")
+	}
+	if c.MaxMessagesPerSession < 0 {
+		return errors.New("max-messages-per-session must not be negative")
+	}
 	// Poor mans email validation, but since emails have a very large domain this is probably good enough
 	// to catch user error.
 	if c.From != "" && !strings.ContainsRune(c.From, '@') {
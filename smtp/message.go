@@ -0,0 +1,165 @@
+package smtp
+
+import (
+	"io"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/jaytaylor/html2text"
+	"github.com/pkg/errors"
+
+	"gopkg.in/gomail.v2"
+)
+
+// Attachment represents a file to attach or embed in an outgoing message.
+// Set Data to attach in-memory content (Name is then required), or set Path
+// to attach a file from disk (Name is optional and overrides the displayed
+// filename).
+type Attachment struct {
+	// Name is the filename presented to the recipient.
+	Name string
+	// Path is a path to a file on disk to attach. Ignored if Data is set.
+	Path string
+	// Data holds the attachment contents when attaching in-memory content
+	// rather than a file on disk.
+	Data []byte
+}
+
+// Message describes an outgoing alert email, including recipients, headers,
+// and any attachments or inline images to include.
+type Message struct {
+	// To, Cc, and Bcc are the message recipients. If To is empty, the
+	// service's configured default recipients are used.
+	To  []string
+	Cc  []string
+	Bcc []string
+
+	// ReplyTo, if set, is added as the message's Reply-To header.
+	ReplyTo string
+
+	// Headers holds any additional headers to set on the message.
+	Headers map[string]string
+
+	Subject string
+	Body    string
+
+	// ContentType overrides the service's configured content type for this
+	// message, e.g. "text/plain". Leave empty to use the default.
+	ContentType string
+
+	// Attachments are attached as regular file attachments.
+	Attachments []Attachment
+	// Embeds are attached as inline content, e.g. images referenced from the
+	// HTML body via a "cid:" URL.
+	Embeds []Attachment
+}
+
+// SendMessage takes in your message parameters and, you know, sends the
+// mail. Unlike SendMail it supports Cc/Bcc, custom headers, and
+// attachments/inline images. The message is queued (and, if SpoolDir is
+// configured, persisted to disk) rather than sent synchronously.
+func (s *Service) SendMessage(msg Message) error {
+	// Validate eagerly so callers get immediate feedback for bad input; the
+	// gomail.Message itself is built lazily once the mailer is ready to
+	// send, so queued messages stay plain, serializable data in the
+	// meantime.
+	if _, err := s.prepareMessge(msg); err != nil {
+		return err
+	}
+	qm := s.spool.enqueue(msg)
+	s.mail <- qm
+	depth := atomic.AddInt64(&s.queueDepth, 1)
+	s.diag.SetQueueDepth(int(depth))
+	return nil
+}
+
+func (s *Service) prepareMessge(msg Message) (*gomail.Message, error) {
+	c := s.config()
+	if !c.Enabled {
+		return nil, errors.New("service is not enabled")
+	}
+	to := msg.To
+	if len(to) == 0 {
+		to = c.To
+	}
+	if len(to) == 0 && len(msg.Cc) == 0 && len(msg.Bcc) == 0 {
+		return nil, ErrNoRecipients
+	}
+
+	contentType := msg.ContentType
+	if contentType == "" {
+		contentType = "text/html"
+		if c.UsePlainText {
+			contentType = "text/plain"
+		}
+	}
+
+	m := gomail.NewMessage()
+	m.SetHeader("From", c.From)
+	if len(to) > 0 {
+		m.SetHeader("To", to...)
+	}
+	if len(msg.Cc) > 0 {
+		m.SetHeader("Cc", msg.Cc...)
+	}
+	if len(msg.Bcc) > 0 {
+		m.SetHeader("Bcc", msg.Bcc...)
+	}
+	if msg.ReplyTo != "" {
+		m.SetHeader("Reply-To", msg.ReplyTo)
+	}
+	for k, v := range msg.Headers {
+		m.SetHeader(k, v)
+	}
+	m.SetHeader("Subject", c.SubjectPrefix+msg.Subject)
+	m.SetBody(contentType, msg.Body)
+	if c.AddPlainTextAlt && contentType == "text/html" {
+		alt, err := html2text.FromString(msg.Body, html2text.Options{PrettyTables: false})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to generate plain text alternative")
+		}
+		m.AddAlternative("text/plain", alt)
+	}
+
+	for _, a := range msg.Attachments {
+		if err := attach(m, a, false); err != nil {
+			return nil, err
+		}
+	}
+	for _, a := range msg.Embeds {
+		if err := attach(m, a, true); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// attach adds a to m, either as a regular attachment or, when embed is true,
+// as inline content.
+func attach(m *gomail.Message, a Attachment, embed bool) error {
+	filename := a.Path
+	var settings []gomail.FileSetting
+	if a.Data != nil {
+		if a.Name == "" {
+			return errors.New("attachment name is required when attaching from data")
+		}
+		filename = a.Name
+		data := a.Data
+		settings = append(settings, gomail.SetCopyFunc(func(w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		}))
+	} else if a.Name != "" && a.Name != filepath.Base(filename) {
+		settings = append(settings, gomail.Rename(a.Name))
+	}
+	if filename == "" {
+		return errors.New("attachment must set either Path or Name and Data")
+	}
+	if embed {
+		m.Embed(filename, settings...)
+	} else {
+		m.Attach(filename, settings...)
+	}
+	return nil
+}
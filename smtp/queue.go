@@ -0,0 +1,264 @@
+package smtp
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultQueueSize is used for the outbound mail queue when Config.QueueSize
+// is unset.
+const defaultQueueSize = 100
+
+// queuedMessage pairs a Message with its delivery bookkeeping, as persisted
+// to the spool so pending mail survives a restart.
+type queuedMessage struct {
+	ID      int64   `json:"id"`
+	Message Message `json:"message"`
+	Attempt int     `json:"attempt"`
+
+	// Removed marks this record as a tombstone for ID, written when a
+	// message is fully handled (delivered or dead-lettered). Without it, a
+	// crash between handling a message and the next clean close() (which is
+	// the only thing that otherwise compacts the journal) would make load()
+	// resurrect and resend it.
+	Removed bool `json:"removed,omitempty"`
+}
+
+// spool is an append-only, on-disk journal of the outbound queue, so a
+// transient SMTP outage (or a restart) does not silently lose alerts. A nil
+// *spool is valid and simply disables persistence, which is the case when
+// Config.SpoolDir is unset.
+type spool struct {
+	mu      sync.Mutex
+	path    string
+	f       *os.File
+	nextID  int64
+	pending map[int64]queuedMessage
+}
+
+func newSpool(dir string) (*spool, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "failed to create spool-dir")
+	}
+	path := filepath.Join(dir, "queue.jsonl")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open spool file")
+	}
+	return &spool{path: path, f: f, pending: make(map[int64]queuedMessage)}, nil
+}
+
+// load replays every message still pending in the spool, e.g. after a
+// restart, and primes the spool's id counter. It is only ever called once,
+// right after Open.
+func (sp *spool) load() ([]queuedMessage, error) {
+	if sp == nil {
+		return nil, nil
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	if _, err := sp.f.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(sp.f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var qm queuedMessage
+		if err := json.Unmarshal(line, &qm); err != nil {
+			// A truncated final line from a crash mid-write; skip it.
+			continue
+		}
+		// The spool is append-only, so a later line for the same ID (e.g. a
+		// retry with a bumped Attempt, or a tombstone from remove) always
+		// supersedes an earlier one.
+		if qm.Removed {
+			delete(sp.pending, qm.ID)
+		} else {
+			sp.pending[qm.ID] = qm
+		}
+		if qm.ID >= sp.nextID {
+			sp.nextID = qm.ID + 1
+		}
+	}
+	if _, err := sp.f.Seek(0, 2); err != nil {
+		return nil, err
+	}
+
+	queued := make([]queuedMessage, 0, len(sp.pending))
+	for _, qm := range sp.pending {
+		queued = append(queued, qm)
+	}
+	return queued, scanner.Err()
+}
+
+// enqueue assigns msg an ID and persists it to the spool (if configured).
+func (sp *spool) enqueue(msg Message) queuedMessage {
+	if sp == nil {
+		return queuedMessage{Message: msg}
+	}
+
+	sp.mu.Lock()
+	id := sp.nextID
+	sp.nextID++
+	qm := queuedMessage{ID: id, Message: msg}
+	sp.pending[id] = qm
+	sp.mu.Unlock()
+
+	sp.appendLine(qm)
+	return qm
+}
+
+// persist re-appends qm to the spool, e.g. a message whose retry attempt
+// count was just bumped.
+func (sp *spool) persist(qm queuedMessage) {
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	sp.pending[qm.ID] = qm
+	sp.mu.Unlock()
+	sp.appendLine(qm)
+}
+
+// remove marks qm as handled, whether delivered or dead-lettered, appending
+// a tombstone so a crash before the next clean close() doesn't make load()
+// resurrect and resend it.
+func (sp *spool) remove(qm queuedMessage) {
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	delete(sp.pending, qm.ID)
+	sp.mu.Unlock()
+	sp.appendLine(queuedMessage{ID: qm.ID, Removed: true})
+}
+
+func (sp *spool) appendLine(qm queuedMessage) {
+	b, err := json.Marshal(qm)
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.f.Write(b)
+}
+
+// close compacts the spool down to whatever is still pending and closes the
+// underlying file. Messages are already durable once enqueue/persist has
+// appended them; since the journal is otherwise only ever appended to,
+// this is the only place superseded lines and tombstones are dropped.
+func (sp *spool) close() error {
+	if sp == nil {
+		return nil
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	tmpPath := sp.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to compact spool")
+	}
+	for _, qm := range sp.pending {
+		b, err := json.Marshal(qm)
+		if err != nil {
+			continue
+		}
+		tmp.Write(append(b, '\n'))
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := sp.f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, sp.path)
+}
+
+// retryQueue holds messages that failed to send and are waiting for their
+// backoff to elapse before being retried.
+type retryQueue struct {
+	maxRetries int
+	baseDelay  time.Duration
+	entries    []retryEntry
+}
+
+type retryEntry struct {
+	queuedMessage
+	at time.Time
+}
+
+func newRetryQueue(maxRetries int, baseDelay time.Duration) *retryQueue {
+	q := &retryQueue{}
+	q.configure(maxRetries, baseDelay)
+	return q
+}
+
+// configure updates the retry limit and base backoff, e.g. after a live
+// Config update.
+func (q *retryQueue) configure(maxRetries int, baseDelay time.Duration) {
+	if baseDelay <= 0 {
+		baseDelay = time.Second
+	}
+	q.maxRetries = maxRetries
+	q.baseDelay = baseDelay
+}
+
+// schedule records qm for a future retry attempt, doubling the backoff for
+// each attempt already made, and returns the message with its Attempt count
+// bumped. It returns ok=false if qm has exhausted maxRetries and should be
+// dead-lettered instead.
+func (q *retryQueue) schedule(qm queuedMessage) (next queuedMessage, ok bool) {
+	qm.Attempt++
+	if q.maxRetries > 0 && qm.Attempt > q.maxRetries {
+		return qm, false
+	}
+	delay := q.baseDelay << uint(qm.Attempt-1)
+	if delay <= 0 || delay > 10*time.Minute {
+		delay = 10 * time.Minute
+	}
+	q.entries = append(q.entries, retryEntry{queuedMessage: qm, at: time.Now().Add(delay)})
+	return qm, true
+}
+
+// requeue re-adds qm to the backoff list without counting it as a new
+// attempt, e.g. when the outbound queue was briefly full and a due retry
+// couldn't be delivered this tick.
+func (q *retryQueue) requeue(qm queuedMessage, delay time.Duration) {
+	q.entries = append(q.entries, retryEntry{queuedMessage: qm, at: time.Now().Add(delay)})
+}
+
+// due pops and returns every entry whose backoff has elapsed.
+func (q *retryQueue) due() []queuedMessage {
+	if len(q.entries) == 0 {
+		return nil
+	}
+	now := time.Now()
+	var due []queuedMessage
+	remaining := q.entries[:0]
+	for _, e := range q.entries {
+		if !now.Before(e.at) {
+			due = append(due, e.queuedMessage)
+		} else {
+			remaining = append(remaining, e)
+		}
+	}
+	q.entries = remaining
+	return due
+}
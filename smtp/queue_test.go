@@ -0,0 +1,134 @@
+package smtp
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSpoolRoundTrip(t *testing.T) {
+	dir, err := os.MkdirTemp("", "goticket-smtp-spool")
+	if err != nil {
+		t.Fatalf("MkdirTemp: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sp, err := newSpool(dir)
+	if err != nil {
+		t.Fatalf("newSpool: %v", err)
+	}
+	qm := sp.enqueue(Message{Subject: "hello"})
+	if err := sp.close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	reopened, err := newSpool(dir)
+	if err != nil {
+		t.Fatalf("newSpool (reopen): %v", err)
+	}
+	defer reopened.close()
+
+	pending, err := reopened.load()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(pending) != 1 {
+		t.Fatalf("expected 1 pending message after replay, got %d", len(pending))
+	}
+	if pending[0].ID != qm.ID || pending[0].Message.Subject != "hello" {
+		t.Fatalf("replayed message does not match enqueued one: got %+v", pending[0])
+	}
+}
+
+func TestSpoolRemoveNotReplayed(t *testing.T) {
+	dir, err := os.MkdirTemp("", "goticket-smtp-spool")
+	if err != nil {
+		t.Fatalf("MkdirTemp: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sp, err := newSpool(dir)
+	if err != nil {
+		t.Fatalf("newSpool: %v", err)
+	}
+	keep := sp.enqueue(Message{Subject: "keep"})
+	drop := sp.enqueue(Message{Subject: "drop"})
+	sp.remove(drop)
+	if err := sp.close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	reopened, err := newSpool(dir)
+	if err != nil {
+		t.Fatalf("newSpool (reopen): %v", err)
+	}
+	defer reopened.close()
+
+	pending, err := reopened.load()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(pending) != 1 || pending[0].ID != keep.ID {
+		t.Fatalf("expected only %+v to survive compaction, got %+v", keep, pending)
+	}
+}
+
+func TestSpoolRemoveTombstoneSurvivesCrash(t *testing.T) {
+	dir, err := os.MkdirTemp("", "goticket-smtp-spool")
+	if err != nil {
+		t.Fatalf("MkdirTemp: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sp, err := newSpool(dir)
+	if err != nil {
+		t.Fatalf("newSpool: %v", err)
+	}
+	keep := sp.enqueue(Message{Subject: "keep"})
+	drop := sp.enqueue(Message{Subject: "drop"})
+	sp.remove(drop)
+	// No sp.close(): simulate a crash between handling "drop" and the next
+	// clean compaction, when only the append-only journal survives.
+
+	reopened, err := newSpool(dir)
+	if err != nil {
+		t.Fatalf("newSpool (reopen): %v", err)
+	}
+	defer reopened.close()
+
+	pending, err := reopened.load()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(pending) != 1 || pending[0].ID != keep.ID {
+		t.Fatalf("expected only %+v to replay after a crash, got %+v (tombstone not honored)", keep, pending)
+	}
+}
+
+func TestRetryQueueScheduleAndDue(t *testing.T) {
+	q := newRetryQueue(2, time.Millisecond)
+
+	qm := queuedMessage{ID: 1, Message: Message{Subject: "retry me"}}
+
+	next, ok := q.schedule(qm)
+	if !ok || next.Attempt != 1 {
+		t.Fatalf("expected first schedule to succeed with Attempt=1, got ok=%v attempt=%d", ok, next.Attempt)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(q.due()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("message never became due")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	next, ok = q.schedule(next)
+	if !ok || next.Attempt != 2 {
+		t.Fatalf("expected second schedule to succeed with Attempt=2, got ok=%v attempt=%d", ok, next.Attempt)
+	}
+
+	if _, ok = q.schedule(next); ok {
+		t.Fatal("expected schedule to refuse a third attempt past maxRetries=2")
+	}
+}
@@ -0,0 +1,181 @@
+package smtp
+
+import (
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/kapacitor/alert"
+	"github.com/pkg/errors"
+
+	gosmtp "github.com/emersion/go-smtp"
+)
+
+// EventDispatcher routes an inbound alert.Event, converted from a received
+// email, to the Kapacitor topic it was addressed to.
+type EventDispatcher interface {
+	DispatchEvent(topic string, event alert.Event) error
+}
+
+// Receiver listens for inbound SMTP connections and converts each message
+// addressed to "<ServerAddrPrefix><topic>@<domain>" into an alert.Event
+// dispatched to that topic, making email a bi-directional integration rather
+// than purely outbound. Every such event has level OK, with the message's
+// Subject as its message and its body as its details; no other event field
+// is taken from the email, and no alert is acknowledged.
+type Receiver struct {
+	configValue atomic.Value
+	dispatcher  EventDispatcher
+	diag        Diagnostic
+	server      *gosmtp.Server
+}
+
+// NewReceiver creates a new Receiver; call Open to start listening.
+func NewReceiver(c Config, dispatcher EventDispatcher, d Diagnostic) *Receiver {
+	r := &Receiver{
+		dispatcher: dispatcher,
+		diag:       d,
+	}
+	r.configValue.Store(c)
+	return r
+}
+
+func (r *Receiver) config() Config {
+	return r.configValue.Load().(Config)
+}
+
+// Open starts accepting inbound mail if Config.ServerListen is set.
+func (r *Receiver) Open() error {
+	c := r.config()
+	if c.ServerListen == "" {
+		return nil
+	}
+
+	s := gosmtp.NewServer(&backend{r: r})
+	s.Addr = c.ServerListen
+	s.Domain = c.ServerDomain
+	s.ReadTimeout = 30 * time.Second
+	s.WriteTimeout = 30 * time.Second
+	s.MaxMessageBytes = 1024 * 1024
+	s.MaxRecipients = 50
+	s.AllowInsecureAuth = true
+
+	r.server = s
+
+	go func() {
+		if err := s.ListenAndServe(); err != nil {
+			r.diag.Error("SMTP receiver stopped", err)
+		}
+	}()
+
+	return nil
+}
+
+// Close stops the receiver from accepting new connections.
+func (r *Receiver) Close() error {
+	if r.server == nil {
+		return nil
+	}
+	return r.server.Close()
+}
+
+// Update stores a new configuration. Changes to ServerListen only take
+// effect the next time the receiver is opened.
+func (r *Receiver) Update(newConfig []interface{}) error {
+	if l := len(newConfig); l != 1 {
+		return errors.Errorf("expected only one new config object, got %d", l)
+	}
+	c, ok := newConfig[0].(Config)
+	if !ok {
+		return errors.Errorf("expected config object to be of type %T, got %T", c, newConfig[0])
+	}
+	r.configValue.Store(c)
+	return nil
+}
+
+// topicFor maps an inbound recipient's local-part to a Kapacitor topic via
+// Config.ServerAddrPrefix, e.g. "alert-cpu@example.com" maps to "cpu".
+func (r *Receiver) topicFor(to string) (string, bool) {
+	addr, err := mail.ParseAddress(to)
+	if err != nil {
+		return "", false
+	}
+	local := addr.Address
+	if i := strings.IndexByte(local, '@'); i >= 0 {
+		local = local[:i]
+	}
+	prefix := r.config().ServerAddrPrefix
+	if prefix == "" || !strings.HasPrefix(local, prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(local, prefix), true
+}
+
+// backend implements gosmtp.Backend, handing out a fresh session per
+// connection.
+type backend struct {
+	r *Receiver
+}
+
+func (be *backend) NewSession(c *gosmtp.Conn) (gosmtp.Session, error) {
+	return &session{r: be.r}, nil
+}
+
+// session implements gosmtp.Session, collecting the topics an inbound
+// message is addressed to and dispatching it as an alert.Event once the
+// message body has been received.
+type session struct {
+	r      *Receiver
+	topics []string
+}
+
+func (sess *session) Mail(from string, opts *gosmtp.MailOptions) error {
+	return nil
+}
+
+func (sess *session) Rcpt(to string, opts *gosmtp.RcptOptions) error {
+	topic, ok := sess.r.topicFor(to)
+	if !ok {
+		return errors.Errorf("no topic mapped for recipient %q", to)
+	}
+	sess.topics = append(sess.topics, topic)
+	return nil
+}
+
+func (sess *session) Data(r io.Reader) error {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse inbound message")
+	}
+	body, err := ioutil.ReadAll(msg.Body)
+	if err != nil {
+		return errors.Wrap(err, "failed to read inbound message body")
+	}
+
+	event := alert.Event{
+		State: alert.EventState{
+			Message: msg.Header.Get("Subject"),
+			Details: string(body),
+			Time:    time.Now(),
+			Level:   alert.OK,
+		},
+	}
+
+	for _, topic := range sess.topics {
+		if err := sess.r.dispatcher.DispatchEvent(topic, event); err != nil {
+			sess.r.diag.Error("failed to dispatch inbound alert event", err)
+		}
+	}
+	return nil
+}
+
+func (sess *session) Reset() {
+	sess.topics = nil
+}
+
+func (sess *session) Logout() error {
+	return nil
+}
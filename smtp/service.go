@@ -2,6 +2,12 @@ package smtp
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"net"
+	netsmtp "net/smtp"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -20,50 +26,111 @@ var ErrNoRecipients = errors.New("not sending email, no recipients defined")
 type Diagnostic interface {
 	WithContext(ctx ...keyvalue.T) Diagnostic
 	Error(msg string, err error)
+
+	// DeadLetter is called when a message is being permanently dropped:
+	// either it has exhausted Config.MaxRetries, or it could not be built
+	// into an email when its turn to send came (no retry is made then).
+	DeadLetter(subject string, err error)
+
+	// IncMessagesSent counts a message that was successfully sent.
+	IncMessagesSent()
+	// IncSendErrors counts a failure to send a message (before retry).
+	IncSendErrors()
+	// IncDialErrors counts a failure to dial the SMTP server.
+	IncDialErrors()
+	// SetQueueDepth reports the current depth of the outbound mail queue.
+	SetQueueDepth(depth int)
 }
 
 // Service keeps things under control.
 type Service struct {
 	mu          sync.Mutex
 	configValue atomic.Value
-	mail        chan *gomail.Message
-	updates     chan bool
+	configGen   int64 // atomic; bumped by Update so workers know to redial
+	mail        chan queuedMessage
+	stop        chan struct{}
 	diag        Diagnostic
 	wg          sync.WaitGroup
+	retryWg     sync.WaitGroup
 	opened      bool
+	spool       *spool
+	queueDepth  int64 // atomic
+
+	retryMu sync.Mutex
+	retries *retryQueue
 }
 
 // NewService is where it all starts, we pass in our configuration and diagnostics.
 func NewService(c Config, d Diagnostic) *Service {
 	s := &Service{
-		updates: make(chan bool),
-		diag:    d,
+		diag: d,
 	}
 	s.configValue.Store(c)
 	return s
 }
 
-// Open opens a new mailer.
+// Open opens the mailer, starting Config.PoolSize worker connections that
+// share the outbound queue.
 func (s *Service) Open() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if s.opened {
 		return nil
 	}
-	s.opened = true
 
-	s.mail = make(chan *gomail.Message)
+	c := s.config()
+	queueSize := c.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+	poolSize := c.PoolSize
+	if poolSize <= 0 {
+		poolSize = 1
+	}
 
-	s.wg.Add(1)
+	sp, err := newSpool(c.SpoolDir)
+	if err != nil {
+		return errors.Wrap(err, "failed to open spool")
+	}
+	pending, err := sp.load()
+	if err != nil {
+		s.diag.Error("error replaying spool", err)
+	}
+
+	s.opened = true
+	s.spool = sp
+	s.mail = make(chan queuedMessage, queueSize)
+	s.stop = make(chan struct{})
+	s.retries = newRetryQueue(c.MaxRetries, c.RetryInterval)
+	atomic.StoreInt64(&s.queueDepth, int64(len(pending)))
+	s.diag.SetQueueDepth(len(pending))
+
+	// Spread replayed messages as evenly as possible across the pool so a
+	// backlog after a restart isn't sent by a single worker alone.
+	for i := 0; i < poolSize; i++ {
+		var share []queuedMessage
+		for j := i; j < len(pending); j += poolSize {
+			share = append(share, pending[j])
+		}
+		s.wg.Add(1)
+		go func(id int, share []queuedMessage) {
+			defer s.wg.Done()
+			s.worker(id, share)
+		}(i, share)
+	}
+
+	s.retryWg.Add(1)
 	go func() {
-		defer s.wg.Done()
-		s.runMailer()
+		defer s.retryWg.Done()
+		s.retryLoop()
 	}()
 
 	return nil
 }
 
-// Close closes the mailer.
+// Close stops accepting new mail, waits for the worker pool to drain, and
+// persists any still-pending messages to the spool (if configured) so they
+// are not lost.
 func (s *Service) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -72,18 +139,25 @@ func (s *Service) Close() error {
 	}
 	s.opened = false
 
+	close(s.stop)
+	// retryLoop must fully exit, and therefore stop touching s.mail, before
+	// we close it: otherwise a redelivery attempt racing the close below
+	// would panic sending on a closed channel.
+	s.retryWg.Wait()
 	close(s.mail)
 	s.wg.Wait()
 
-	return nil
+	return s.spool.close()
 }
 
 func (s *Service) config() Config {
 	return s.configValue.Load().(Config)
 }
 
-// Update allows a convienent way to pass in new configurations
-// which will create a new dialer.
+// Update allows a convienent way to pass in new configurations. Workers
+// pick up the new dialer settings once they finish whatever they're
+// currently sending, rather than having their in-flight connection torn
+// down out from under them.
 func (s *Service) Update(newConfig []interface{}) error {
 	if l := len(newConfig); l != 1 {
 		return errors.Errorf("expected only one new config object, got %d", l)
@@ -95,13 +169,7 @@ func (s *Service) Update(newConfig []interface{}) error {
 	}
 
 	s.configValue.Store(c)
-	s.mu.Lock()
-	opened := s.opened
-	s.mu.Unlock()
-	if opened {
-		// Signal to create new dialer
-		s.updates <- true
-	}
+	atomic.AddInt64(&s.configGen, 1)
 
 	return nil
 }
@@ -118,103 +186,372 @@ func (s *Service) StateChangesOnly() bool {
 	return c.StateChangesOnly
 }
 
-func (s *Service) dialer() (d *gomail.Dialer, idleTimeout time.Duration) {
+// smtpDialer is the common interface satisfied by *gomail.Dialer and our
+// own cleartextDialer/requiredSTARTTLSDialer below, so worker can dial
+// without caring which TLSMode produced the connection.
+type smtpDialer interface {
+	Dial() (gomail.SendCloser, error)
+}
+
+func (s *Service) dialer() (d smtpDialer, idleTimeout time.Duration, err error) {
 	c := s.config()
+
+	serverName := c.ServerName
+	if serverName == "" {
+		serverName = c.Host
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.NoVerify, ServerName: serverName}
+	if c.CAFile != "" {
+		pool, caErr := loadCAFile(c.CAFile)
+		if caErr != nil {
+			return nil, 0, errors.Wrap(caErr, "failed to load ca-file")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if c.ClientCert != "" {
+		cert, certErr := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+		if certErr != nil {
+			return nil, 0, errors.Wrap(certErr, "failed to load client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	switch c.TLSMode {
+	case "", TLSModeSTARTTLS:
+		d = plainGomailDialer(c, tlsConfig, false)
+	case TLSModeTLS:
+		d = plainGomailDialer(c, tlsConfig, true)
+	case TLSModeNone:
+		// gomail.Dialer has no knob to suppress STARTTLS: it always
+		// upgrades opportunistically whenever the server advertises it,
+		// regardless of TLSConfig. Speak SMTP ourselves so "none" really
+		// does mean cleartext.
+		d = &cleartextDialer{host: c.Host, port: c.Port, username: c.Username, password: c.Password}
+	case TLSModeSTARTTLSRequired:
+		// Check the STARTTLS extension on the very connection we're about
+		// to send on, rather than a separate throwaway connection: a
+		// pre-flight probe can land on a different backend behind a load
+		// balancer/VIP than the real send does, and costs a second
+		// connect+greeting per message.
+		d = &requiredSTARTTLSDialer{host: c.Host, port: c.Port, username: c.Username, password: c.Password, tlsConfig: tlsConfig}
+	default:
+		return nil, 0, errors.Errorf("unknown tls-mode %q", c.TLSMode)
+	}
+
+	idleTimeout = time.Duration(c.IdleTimeout)
+	return d, idleTimeout, nil
+}
+
+// plainGomailDialer builds the *gomail.Dialer used for the opportunistic
+// "starttls" (the default) and implicit "tls" modes, which gomail already
+// handles correctly.
+func plainGomailDialer(c Config, tlsConfig *tls.Config, ssl bool) *gomail.Dialer {
+	var d *gomail.Dialer
 	if c.Username == "" {
 		d = &gomail.Dialer{Host: c.Host, Port: c.Port}
 	} else {
 		d = gomail.NewPlainDialer(c.Host, c.Port, c.Username, c.Password)
 	}
-	if c.NoVerify {
-		d.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	d.SSL = ssl
+	d.TLSConfig = tlsConfig
+	return d
+}
+
+func dialSMTP(host string, port int) (*netsmtp.Client, error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to SMTP server")
 	}
-	idleTimeout = time.Duration(c.IdleTimeout)
-	return
+	client, err := netsmtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "failed to create SMTP client")
+	}
+	return client, nil
 }
 
-func (s *Service) runMailer() {
-	var idleTimeout time.Duration
-	var d *gomail.Dialer
-	d, idleTimeout = s.dialer()
+// cleartextDialer dials an SMTP server and sends without ever attempting
+// STARTTLS, for TLSModeNone. Authentication over it relies on net/smtp's own
+// refusal to send credentials over a non-TLS, non-localhost connection.
+type cleartextDialer struct {
+	host, username, password string
+	port                     int
+}
 
+func (d *cleartextDialer) Dial() (gomail.SendCloser, error) {
+	client, err := dialSMTP(d.host, d.port)
+	if err != nil {
+		return nil, err
+	}
+	if d.username != "" {
+		if err := client.Auth(netsmtp.PlainAuth("", d.username, d.password, d.host)); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	return &smtpClientSender{c: client}, nil
+}
+
+// requiredSTARTTLSDialer dials an SMTP server, refuses to proceed if it
+// doesn't advertise STARTTLS, and otherwise upgrades the same connection
+// before sending, for TLSModeSTARTTLSRequired.
+type requiredSTARTTLSDialer struct {
+	host, username, password string
+	port                     int
+	tlsConfig                *tls.Config
+}
+
+func (d *requiredSTARTTLSDialer) Dial() (gomail.SendCloser, error) {
+	client, err := dialSMTP(d.host, d.port)
+	if err != nil {
+		return nil, err
+	}
+	if ok, _ := client.Extension("STARTTLS"); !ok {
+		client.Close()
+		return nil, errors.New("SMTP server does not advertise STARTTLS and tls-mode is starttls-required")
+	}
+	if err := client.StartTLS(d.tlsConfig); err != nil {
+		client.Close()
+		return nil, errors.Wrap(err, "STARTTLS failed")
+	}
+	if d.username != "" {
+		if err := client.Auth(netsmtp.PlainAuth("", d.username, d.password, d.host)); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	return &smtpClientSender{c: client}, nil
+}
+
+// smtpClientSender adapts a *net/smtp.Client to gomail.SendCloser so
+// cleartextDialer and requiredSTARTTLSDialer can be used as drop-in
+// replacements for gomail.Dialer's own sender.
+type smtpClientSender struct {
+	c *netsmtp.Client
+}
+
+func (s *smtpClientSender) Send(from string, to []string, msg io.WriterTo) error {
+	if err := s.c.Mail(from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := s.c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := s.c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := msg.WriteTo(w); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (s *smtpClientSender) Close() error {
+	return s.c.Quit()
+}
+
+func loadCAFile(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in ca-file")
+	}
+	return pool, nil
+}
+
+// worker owns a single SMTP connection and repeatedly pulls messages off
+// s.mail, re-dialing after Config.MaxMessagesPerSession sends or after the
+// connection has gone idle for Config.IdleTimeout. It also redials whenever
+// Update has stored newer config, but only between messages so an in-flight
+// send is never interrupted. pending holds messages replayed from the spool
+// on Open that belong to this worker's share of the backlog.
+func (s *Service) worker(id int, pending []queuedMessage) {
+	var d smtpDialer
 	var conn gomail.SendCloser
+	var idleTimeout time.Duration
+	var sentThisSession int
+	gen := atomic.LoadInt64(&s.configGen)
+
+	redial := func() {
+		if conn != nil {
+			if err := conn.Close(); err != nil {
+				s.diag.Error("error closing connection to SMTP server", err)
+			}
+			conn = nil
+		}
+		var err error
+		d, idleTimeout, err = s.dialer()
+		if err != nil {
+			s.diag.Error("error configuring SMTP dialer", err)
+			d = nil
+		}
+		if idleTimeout <= 0 {
+			// A zero timeout (e.g. from a dialer error, or Config.IdleTimeout
+			// left at zero) would otherwise fire the timer below
+			// immediately on every loop iteration and busy-spin the worker.
+			idleTimeout = 30 * time.Second
+		}
+		gen = atomic.LoadInt64(&s.configGen)
+		sentThisSession = 0
+	}
+	redial()
+
+	send := func(qm queuedMessage) {
+		if conn != nil {
+			maxPerSession := s.config().MaxMessagesPerSession
+			if (maxPerSession > 0 && sentThisSession >= maxPerSession) || atomic.LoadInt64(&s.configGen) != gen {
+				redial()
+			}
+		} else if atomic.LoadInt64(&s.configGen) != gen {
+			redial()
+		}
+
+		if d == nil {
+			s.retryOrDrop(qm, errors.New("SMTP dialer is not configured"))
+			return
+		}
+		m, err := s.prepareMessge(qm.Message)
+		if err != nil {
+			// The message is invalid, or the service has been disabled
+			// since it was queued; it is dropped without a retry.
+			s.spool.remove(qm)
+			s.diag.DeadLetter(qm.Message.Subject, err)
+			return
+		}
+		if conn == nil {
+			if conn, err = d.Dial(); err != nil {
+				s.diag.IncDialErrors()
+				s.retryOrDrop(qm, err)
+				return
+			}
+		}
+		if err := gomail.Send(conn, m); err != nil {
+			s.diag.IncSendErrors()
+			// The connection may be in a bad state; drop it so the next
+			// attempt starts fresh rather than reusing it.
+			conn.Close()
+			conn = nil
+			s.retryOrDrop(qm, err)
+			return
+		}
+		sentThisSession++
+		s.diag.IncMessagesSent()
+		s.spool.remove(qm)
+	}
+
+	for _, qm := range pending {
+		// These were already counted into s.queueDepth when Open seeded it
+		// from the replayed spool; decrement the same way the s.mail receive
+		// below does, so the gauge doesn't stay inflated by the replay count
+		// forever.
+		depth := atomic.AddInt64(&s.queueDepth, -1)
+		s.diag.SetQueueDepth(int(depth))
+		send(qm)
+	}
+
 	defer func() {
 		if conn != nil {
 			conn.Close()
 		}
 	}()
 
-	var err error
-	open := false
 	for {
 		timer := time.NewTimer(idleTimeout)
 		select {
-		case <-s.updates:
-			// Close old connection
-			if conn != nil {
-				if err := conn.Close(); err != nil {
-					s.diag.Error("error closing connection to old SMTP server", err)
-				}
-				conn = nil
-			}
-			// Create new dialer
-			d, idleTimeout = s.dialer()
-			open = false
-		case m, ok := <-s.mail:
+		case qm, ok := <-s.mail:
 			if !ok {
+				timer.Stop()
 				return
 			}
-			if !open {
-				if conn, err = d.Dial(); err != nil {
-					s.diag.Error("error closing connection to SMTP server", err)
-					break
-				}
-				open = true
-			}
-			if err := gomail.Send(conn, m); err != nil {
-				s.diag.Error("error sending", err)
-			}
+			depth := atomic.AddInt64(&s.queueDepth, -1)
+			s.diag.SetQueueDepth(int(depth))
+			send(qm)
 		// Close the connection to the SMTP server if no email was sent in
 		// the last IdleTimeout duration.
 		case <-timer.C:
-			if open {
+			if conn != nil {
 				if err := conn.Close(); err != nil {
 					s.diag.Error("error closing connection to SMTP server", err)
 				}
-				open = false
+				conn = nil
 			}
 		}
 		timer.Stop()
 	}
 }
 
-// SendMail takes in your message parameters and, you know, sends the mail.
-func (s *Service) SendMail(to []string, subject, body string) error {
-	m, err := s.prepareMessge(to, subject, body)
-	if err != nil {
-		return err
-	}
-	s.mail <- m
-	return nil
-}
-
-func (s *Service) prepareMessge(to []string, subject, body string) (*gomail.Message, error) {
+// retryLoop periodically re-enqueues messages whose backoff has elapsed,
+// stopping once Close signals s.stop. It owns s.retries, which is otherwise
+// only ever read here and mutated by retryOrDrop under s.retryMu. Entries
+// are persisted to the spool as soon as retryOrDrop schedules them (not
+// here), so a message that's still waiting on its backoff when Close runs
+// is already durable; retryLoop has nothing left to flush on the way out.
+func (s *Service) retryLoop() {
 	c := s.config()
-	if !c.Enabled {
-		return nil, errors.New("service is not enabled")
+	interval := c.RetryInterval
+	if interval <= 0 {
+		interval = time.Second
 	}
-	if len(to) == 0 {
-		to = c.To
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			cur := s.config()
+			s.retryMu.Lock()
+			s.retries.configure(cur.MaxRetries, cur.RetryInterval)
+			due := s.retries.due()
+			s.retryMu.Unlock()
+			for _, qm := range due {
+				select {
+				case s.mail <- qm:
+					atomic.AddInt64(&s.queueDepth, 1)
+					s.diag.SetQueueDepth(int(atomic.LoadInt64(&s.queueDepth)))
+				default:
+					// Queue is full; try again next tick instead of
+					// blocking the retry loop.
+					s.retryMu.Lock()
+					s.retries.requeue(qm, interval)
+					s.retryMu.Unlock()
+				}
+			}
+		}
 	}
-	if len(to) == 0 {
-		return nil, ErrNoRecipients
+}
+
+// retryOrDrop schedules qm for another attempt, or dead-letters it if it has
+// exhausted Config.MaxRetries. A scheduled retry is persisted to the spool
+// immediately (rather than only on shutdown) so one scheduled while Close is
+// draining the worker pool is never lost.
+func (s *Service) retryOrDrop(qm queuedMessage, cause error) {
+	s.diag.Error("error sending", cause)
+	s.retryMu.Lock()
+	next, scheduled := s.retries.schedule(qm)
+	s.retryMu.Unlock()
+	if scheduled {
+		s.spool.persist(next)
+	} else {
+		s.spool.remove(qm)
+		s.diag.DeadLetter(qm.Message.Subject, cause)
 	}
-	m := gomail.NewMessage()
-	m.SetHeader("From", c.From)
-	m.SetHeader("To", to...)
-	m.SetHeader("Subject", subject)
-	m.SetBody("text/html", body)
-	return m, nil
+}
+
+// SendMail is a convenience wrapper around SendMessage for simple,
+// attachment-free emails. Prefer SendMessage for anything that needs
+// Cc/Bcc, custom headers, or attachments.
+func (s *Service) SendMail(to []string, subject, body string) error {
+	return s.SendMessage(Message{To: to, Subject: subject, Body: body})
 }
 
 type testOptions struct {
@@ -250,6 +587,11 @@ func (s *Service) Test(options interface{}) error {
 type HandlerConfig struct {
 	// List of email recipients.
 	To []string `mapstructure:"to"`
+
+	// ContentType overrides the configured content type for this handler,
+	// e.g. "text/plain" to force a plain-text alert regardless of the
+	// service-wide UsePlainText setting. Leave empty to use the default.
+	ContentType string `mapstructure:"content-type"`
 }
 
 type handler struct {
@@ -269,11 +611,12 @@ func (s *Service) Handler(c HandlerConfig, ctx ...keyvalue.T) alert.Handler {
 
 // Handle actually does the handling of elerts.
 func (h *handler) Handle(event alert.Event) {
-	if err := h.s.SendMail(
-		h.c.To,
-		event.State.Message,
-		event.State.Details,
-	); err != nil {
+	if err := h.s.SendMessage(Message{
+		To:          h.c.To,
+		Subject:     event.State.Message,
+		Body:        event.State.Details,
+		ContentType: h.c.ContentType,
+	}); err != nil {
 		h.diag.Error("failed to send email", err)
 	}
 }